@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const cacheFileName = "black-client/cache.v1"
+
+// defaultCachePath returns $XDG_CACHE_HOME/black-client/cache.v1 (or the
+// platform equivalent via os.UserCacheDir), or "" if no cache directory
+// could be determined.
+func defaultCachePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, cacheFileName)
+}
+
+// blackCache remembers, across runs, the set of files already known to be
+// Black-clean, so a file that hasn't changed since it last came back 204
+// from blackd can skip the HTTP round-trip entirely. Keys are opaque
+// digests produced by cacheKey; see processPath.
+type blackCache struct {
+	mu    sync.Mutex
+	clean map[string]struct{}
+	path  string
+	dirty bool
+}
+
+// openBlackCache loads an existing cache file, if any. A missing or
+// unreadable file just means an empty, cold cache; it is not an error.
+func openBlackCache(path string) *blackCache {
+	c := &blackCache{clean: make(map[string]struct{}), path: path}
+	if path == "" {
+		return c
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return c
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		c.clean[scanner.Text()] = struct{}{}
+	}
+	return c
+}
+
+func (c *blackCache) has(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.clean[key]
+	return ok
+}
+
+func (c *blackCache) add(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.clean[key]; !ok {
+		c.clean[key] = struct{}{}
+		c.dirty = true
+	}
+}
+
+// persist atomically writes the cache to disk via a temp file plus
+// os.Rename, the same pattern overwritePath uses for source files. It's a
+// no-op if nothing changed since the cache was loaded.
+func (c *blackCache) persist() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty || c.path == "" {
+		return nil
+	}
+
+	dir := filepath.Dir(c.path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("cannot persist cache: %v", err)
+	}
+	tmp, err := ioutil.TempFile(dir, filepath.Base(c.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("cannot persist cache: %v", err)
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // no-op once the rename below succeeds
+
+	w := bufio.NewWriter(tmp)
+	for key := range c.clean {
+		if _, err := w.WriteString(key); err == nil {
+			_, err = w.WriteString("\n")
+		}
+		if err != nil {
+			tmp.Close()
+			return fmt.Errorf("cannot persist cache: %v", err)
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("cannot persist cache: %v", err)
+	}
+
+	if err := os.Rename(tmpPath, c.path); err != nil {
+		return fmt.Errorf("cannot persist cache: %v", err)
+	}
+	return nil
+}
+
+// cacheKey combines the file's content hash with everything about conf
+// that can change blackd's output for path, so that the same bytes under a
+// different line length, target version, or blackd release correctly miss
+// the cache.
+func cacheKey(conf BlackConfig, path string, contentHash [32]byte) string {
+	h := sha256.New()
+	h.Write(contentHash[:])
+	fmt.Fprintf(h, "|%d|%s|%t|%t|%t|%t|%s",
+		conf.LineLength,
+		conf.pythonVariant(path),
+		conf.SkipStringNormalization,
+		conf.SkipMagicTrailingComma,
+		conf.Preview,
+		conf.Fast,
+		conf.BlackdVersion,
+	)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hashFile returns the SHA-256 of path's contents.
+func hashFile(path string) ([32]byte, error) {
+	var sum [32]byte
+	f, err := os.Open(path)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// probeBlackdVersion GETs / on a blackd instance and returns its version
+// banner verbatim, so the content cache can be keyed (in part) on it: a
+// blackd upgrade should invalidate previously cached "clean" verdicts. An
+// unreachable or unexpected response just yields "", which still works as
+// a (coarser) cache key. It uses the package's shared client, the same
+// bounded-timeout HTTP client every other blackd request goes through, so
+// an unreachable daemon can't hang startup past the SIGINT/SIGTERM
+// handler's reach.
+func probeBlackdVersion(url string) string {
+	resp, err := client.Get(url + "/")
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return ""
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(body))
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestCacheKeyStableForSameInputs(t *testing.T) {
+	conf := BlackConfig{LineLength: 88, BlackdVersion: "22.3.0"}
+	hash := [32]byte{1, 2, 3}
+
+	a := cacheKey(conf, "mod.py", hash)
+	b := cacheKey(conf, "mod.py", hash)
+	if a != b {
+		t.Fatalf("cacheKey is not deterministic: %q != %q", a, b)
+	}
+}
+
+func TestCacheKeyChangesWithConfig(t *testing.T) {
+	hash := [32]byte{1, 2, 3}
+	base := cacheKey(BlackConfig{LineLength: 88}, "mod.py", hash)
+
+	cases := []struct {
+		name string
+		conf BlackConfig
+	}{
+		{"line length", BlackConfig{LineLength: 79}},
+		{"skip string normalization", BlackConfig{LineLength: 88, SkipStringNormalization: true}},
+		{"preview", BlackConfig{LineLength: 88, Preview: true}},
+		{"blackd version", BlackConfig{LineLength: 88, BlackdVersion: "22.3.0"}},
+	}
+	for _, c := range cases {
+		if got := cacheKey(c.conf, "mod.py", hash); got == base {
+			t.Errorf("%s: cacheKey unchanged from base config, want it to differ", c.name)
+		}
+	}
+}
+
+func TestCacheKeyChangesWithFileHash(t *testing.T) {
+	conf := BlackConfig{LineLength: 88}
+	a := cacheKey(conf, "mod.py", [32]byte{1})
+	b := cacheKey(conf, "mod.py", [32]byte{2})
+	if a == b {
+		t.Fatal("cacheKey should differ for different file content hashes")
+	}
+}
+
+func TestCacheKeyDistinguishesStubFiles(t *testing.T) {
+	conf := BlackConfig{LineLength: 88}
+	hash := [32]byte{1, 2, 3}
+	// A .py and a .pyi file with identical bytes get the same hash but a
+	// different X-Python-Variant header (blackd treats stubs specially),
+	// so they must not collide in the cache.
+	a := cacheKey(conf, "mod.py", hash)
+	b := cacheKey(conf, "mod.pyi", hash)
+	if a == b {
+		t.Fatal("cacheKey should differ between a .py and a .pyi file with the same content hash")
+	}
+}
+
+func TestBlackCachePersistRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.v1")
+
+	c := openBlackCache(path)
+	if c.has("somekey") {
+		t.Fatal("a freshly opened cache over a nonexistent file should be empty")
+	}
+	c.add("somekey")
+	if err := c.persist(); err != nil {
+		t.Fatalf("persist: %v", err)
+	}
+
+	reloaded := openBlackCache(path)
+	if !reloaded.has("somekey") {
+		t.Fatal("a key added and persisted should be present after reopening the cache file")
+	}
+}
+
+func TestBlackCachePersistNoopWhenClean(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.v1")
+	c := openBlackCache(path)
+	if err := c.persist(); err != nil {
+		t.Fatalf("persist: %v", err)
+	}
+	if matches, _ := filepath.Glob(path); len(matches) != 0 {
+		t.Error("persist shouldn't create a file when nothing was added to the cache")
+	}
+}
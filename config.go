@@ -0,0 +1,159 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// BlackConfig holds everything needed to build a blackd request for a
+// single file: which daemon to talk to, the CLI-level output mode, and
+// the formatting options blackd exposes as X- headers.
+type BlackConfig struct {
+	Url   string
+	Diff  bool
+	Check bool
+
+	LineLength              uint
+	TargetVersions          []string
+	SkipStringNormalization bool
+	SkipMagicTrailingComma  bool
+	Preview                 bool
+	Fast                    bool
+
+	MaxRetries   uint
+	RetryTimeout time.Duration
+
+	// BlackdVersion is probed once at startup via GET / and folded into
+	// the content cache key, so a blackd upgrade invalidates stale
+	// "clean" verdicts.
+	BlackdVersion string
+}
+
+// pythonVariant renders the value of the X-Python-Variant header for the
+// given path, following blackd's own convention: a comma-separated list of
+// target versions (e.g. "py36,py37"), with "pyi" added when the file is a
+// stub.
+func (c BlackConfig) pythonVariant(path string) string {
+	variants := append([]string(nil), c.TargetVersions...)
+	if strings.HasSuffix(path, ".pyi") {
+		variants = append(variants, "pyi")
+	}
+	return strings.Join(variants, ",")
+}
+
+// pyprojectBlack mirrors the subset of the `[tool.black]` table that
+// blackd's headers can express. Pointer fields distinguish "absent" from
+// "explicitly false/zero" so that a pyproject.toml only overrides what it
+// actually sets.
+type pyprojectBlack struct {
+	LineLength              *uint    `toml:"line-length"`
+	TargetVersion           []string `toml:"target-version"`
+	SkipStringNormalization *bool    `toml:"skip-string-normalization"`
+	SkipMagicTrailingComma  *bool    `toml:"skip-magic-trailing-comma"`
+	Preview                 *bool    `toml:"preview"`
+}
+
+type pyprojectFile struct {
+	Tool struct {
+		Black pyprojectBlack `toml:"black"`
+	} `toml:"tool"`
+}
+
+// pyprojectCache memoizes, per directory, the nearest pyproject.toml found
+// by walking upward, so that a repo with thousands of files under the same
+// root only pays the filesystem+parse cost once per directory.
+type pyprojectCache struct {
+	mu    sync.Mutex
+	byDir map[string]*pyprojectBlack
+}
+
+func newPyprojectCache() *pyprojectCache {
+	return &pyprojectCache{byDir: make(map[string]*pyprojectBlack)}
+}
+
+// configForPath resolves the effective BlackConfig for a single file: start
+// from the CLI-level base config, then apply whatever `[tool.black]` table
+// is found by walking up from the file's directory to the filesystem root.
+func (c *pyprojectCache) configForPath(base BlackConfig, path string) BlackConfig {
+	conf := base
+	dir := filepath.Dir(path)
+	if black := c.find(dir); black != nil {
+		applyPyprojectBlack(&conf, black)
+	}
+	return conf
+}
+
+func (c *pyprojectCache) find(dir string) *pyprojectBlack {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var visited []string
+	var found *pyprojectBlack
+	for {
+		if black, ok := c.byDir[dir]; ok {
+			found = black
+			break
+		}
+		visited = append(visited, dir)
+
+		black, ok := readPyprojectBlack(filepath.Join(dir, "pyproject.toml"))
+		if ok {
+			found = black
+			break
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	for _, d := range visited {
+		c.byDir[d] = found
+	}
+	return found
+}
+
+// readPyprojectBlack reports ok=false both when path doesn't exist (the
+// normal case while walking upward) and when it exists but fails to parse
+// -- the latter is a real misconfiguration, so it's surfaced via infof
+// instead of being silently treated the same as "no pyproject.toml here".
+func readPyprojectBlack(path string) (*pyprojectBlack, bool) {
+	var pf pyprojectFile
+	if _, err := toml.DecodeFile(path, &pf); err != nil {
+		if !os.IsNotExist(err) {
+			infof("warning: cannot parse %s, ignoring it: %v\n", path, err)
+		}
+		return nil, false
+	}
+	return &pf.Tool.Black, true
+}
+
+func applyPyprojectBlack(conf *BlackConfig, black *pyprojectBlack) {
+	if black.LineLength != nil {
+		conf.LineLength = *black.LineLength
+	}
+	if black.TargetVersion != nil {
+		conf.TargetVersions = black.TargetVersion
+	}
+	if black.SkipStringNormalization != nil {
+		conf.SkipStringNormalization = *black.SkipStringNormalization
+	}
+	if black.SkipMagicTrailingComma != nil {
+		conf.SkipMagicTrailingComma = *black.SkipMagicTrailingComma
+	}
+	if black.Preview != nil {
+		conf.Preview = *black.Preview
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigForPathWalksUpward(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "pyproject.toml"), "[tool.black]\nline-length = 100\n")
+
+	pkg := filepath.Join(root, "pkg", "sub")
+	if err := os.MkdirAll(pkg, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(pkg, "mod.py")
+	writeFile(t, file, "x = 1\n")
+
+	base := BlackConfig{LineLength: 88}
+	conf := newPyprojectCache().configForPath(base, file)
+	if conf.LineLength != 100 {
+		t.Errorf("LineLength = %d, want 100 (from ancestor pyproject.toml)", conf.LineLength)
+	}
+}
+
+func TestConfigForPathNearestWins(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "pyproject.toml"), "[tool.black]\nline-length = 100\n")
+	writeFile(t, filepath.Join(root, "pkg", "pyproject.toml"), "[tool.black]\nline-length = 79\n")
+
+	file := filepath.Join(root, "pkg", "mod.py")
+	writeFile(t, file, "x = 1\n")
+
+	conf := newPyprojectCache().configForPath(BlackConfig{LineLength: 88}, file)
+	if conf.LineLength != 79 {
+		t.Errorf("LineLength = %d, want 79 (nearest pyproject.toml should win)", conf.LineLength)
+	}
+}
+
+func TestConfigForPathNoPyprojectKeepsBase(t *testing.T) {
+	root := t.TempDir()
+	file := filepath.Join(root, "mod.py")
+	writeFile(t, file, "x = 1\n")
+
+	conf := newPyprojectCache().configForPath(BlackConfig{LineLength: 88}, file)
+	if conf.LineLength != 88 {
+		t.Errorf("LineLength = %d, want unchanged base value 88", conf.LineLength)
+	}
+}
+
+func TestReadPyprojectBlackBadSyntax(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "pyproject.toml")
+	writeFile(t, path, "[tool.black\nline-length = 100\n") // missing closing bracket
+
+	black, ok := readPyprojectBlack(path)
+	if ok || black != nil {
+		t.Errorf("readPyprojectBlack(%q) = (%v, %v), want (nil, false) for invalid TOML", path, black, ok)
+	}
+}
+
+func TestReadPyprojectBlackMissingFile(t *testing.T) {
+	black, ok := readPyprojectBlack(filepath.Join(t.TempDir(), "pyproject.toml"))
+	if ok || black != nil {
+		t.Errorf("readPyprojectBlack for a missing file = (%v, %v), want (nil, false)", black, ok)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+)
+
+const (
+	// DefaultIncludePattern mirrors Black's own DEFAULT_INCLUDES: only
+	// Python source files are candidates for formatting.
+	DefaultIncludePattern = `\.pyi?$`
+	// DefaultExcludePattern mirrors Black's own DEFAULT_EXCLUDES: common
+	// VCS, cache, and build directories are pruned from every walk.
+	DefaultExcludePattern = `/(\.direnv|\.eggs|\.git|\.hg|\.mypy_cache|\.nox|\.tox|\.venv|venv|\.svn|\.ivy2|_build|buck-out|build|dist|__pypackages__)/`
+)
+
+// pathFilter decides which paths walkDirectories enqueues, layering
+// --include/--exclude/--force-exclude regexes on top of any .gitignore
+// found at or above each walked path.
+type pathFilter struct {
+	include      *regexp.Regexp
+	exclude      *regexp.Regexp
+	forceExclude *regexp.Regexp // nil when --force-exclude wasn't given
+	gitignore    *gitignoreCache
+}
+
+func newPathFilter(include, exclude, forceExclude string) (*pathFilter, error) {
+	inc, err := regexp.Compile(include)
+	if err != nil {
+		return nil, fmt.Errorf("--include: %v", err)
+	}
+	exc, err := regexp.Compile(exclude)
+	if err != nil {
+		return nil, fmt.Errorf("--exclude: %v", err)
+	}
+	var force *regexp.Regexp
+	if forceExclude != "" {
+		if force, err = regexp.Compile(forceExclude); err != nil {
+			return nil, fmt.Errorf("--force-exclude: %v", err)
+		}
+	}
+	return &pathFilter{
+		include:      inc,
+		exclude:      exc,
+		forceExclude: force,
+		gitignore:    newGitignoreCache(),
+	}, nil
+}
+
+// skipDir reports whether a directory should be pruned from the walk
+// entirely, without visiting any of its children.
+func (f *pathFilter) skipDir(path string) bool {
+	slashed := filepath.ToSlash(path) + "/"
+	if f.exclude.MatchString(slashed) {
+		return true
+	}
+	if f.forceExclude != nil && f.forceExclude.MatchString(slashed) {
+		return true
+	}
+	return f.gitignore.matches(path, true)
+}
+
+// skipFile reports whether a regular file found during the walk should be
+// left alone. Explicitly passed file arguments go through forceExcluded
+// instead, since --include/--exclude only apply to files discovered while
+// walking.
+func (f *pathFilter) skipFile(path string) bool {
+	if f.forceExclude != nil && f.forceExclude.MatchString(path) {
+		return true
+	}
+	if !f.include.MatchString(path) || f.exclude.MatchString(path) {
+		return true
+	}
+	return f.gitignore.matches(path, false)
+}
+
+// forceExcluded reports whether path must be skipped even though it was
+// passed explicitly on the command line.
+func (f *pathFilter) forceExcluded(path string) bool {
+	return f.forceExclude != nil && f.forceExclude.MatchString(path)
+}
+
+// gitignoreCache memoizes, per directory, the cumulative stack of
+// gitignore patterns gathered from that directory and all of its
+// ancestors, so a deep tree only pays to find and parse each .gitignore
+// once.
+type gitignoreCache struct {
+	mu    sync.Mutex
+	byDir map[string][]gitignore.Pattern
+}
+
+func newGitignoreCache() *gitignoreCache {
+	return &gitignoreCache{byDir: make(map[string][]gitignore.Pattern)}
+}
+
+func (c *gitignoreCache) matches(path string, isDir bool) bool {
+	dir := filepath.Dir(path)
+	if isDir {
+		dir = path
+	}
+	patterns := c.patternsFor(dir)
+	if len(patterns) == 0 {
+		return false
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	return gitignore.NewMatcher(patterns).Match(splitPath(abs), isDir)
+}
+
+func (c *gitignoreCache) patternsFor(dir string) []gitignore.Pattern {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.patternsForLocked(abs)
+}
+
+func (c *gitignoreCache) patternsForLocked(dir string) []gitignore.Pattern {
+	if patterns, ok := c.byDir[dir]; ok {
+		return patterns
+	}
+	var patterns []gitignore.Pattern
+	if parent := filepath.Dir(dir); parent != dir {
+		patterns = append(patterns, c.patternsForLocked(parent)...)
+	}
+	patterns = append(patterns, readGitignore(dir)...)
+	c.byDir[dir] = patterns
+	return patterns
+}
+
+// readGitignore parses dir/.gitignore, if any, into patterns domained to
+// dir so that gitignore.Matcher anchors them correctly relative to the
+// rest of the path stack.
+func readGitignore(dir string) []gitignore.Pattern {
+	f, err := os.Open(filepath.Join(dir, ".gitignore"))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	domain := splitPath(dir)
+	var patterns []gitignore.Pattern
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, gitignore.ParsePattern(line, domain))
+	}
+	return patterns
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(filepath.ToSlash(path), "/")
+	return strings.Split(path, "/")
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestFilter(t *testing.T) *pathFilter {
+	t.Helper()
+	f, err := newPathFilter(DefaultIncludePattern, DefaultExcludePattern, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestSkipFileHonorsIncludeAndExclude(t *testing.T) {
+	f := newTestFilter(t)
+
+	if f.skipFile("/repo/mod.py") {
+		t.Error("a .py file shouldn't be skipped by the default include/exclude")
+	}
+	if !f.skipFile("/repo/README.md") {
+		t.Error("a non-Python file should be skipped by the default --include")
+	}
+	if !f.skipFile("/repo/build/generated.py") {
+		t.Error("a .py file under build/ should be skipped by the default --exclude")
+	}
+}
+
+func TestForceExcludeAppliesToExplicitArgs(t *testing.T) {
+	f, err := newPathFilter(DefaultIncludePattern, DefaultExcludePattern, `/vendor/`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.forceExcluded("/repo/vendor/mod.py") {
+		t.Error("--force-exclude should apply even to an explicitly named path")
+	}
+	if f.forceExcluded("/repo/mod.py") {
+		t.Error("--force-exclude shouldn't match a path outside its pattern")
+	}
+}
+
+func TestGitignorePrecedenceStacking(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, ".gitignore"), "*.pyc\nbuild/\n")
+	writeFile(t, filepath.Join(root, "pkg", ".gitignore"), "!important.pyc\n")
+
+	c := newGitignoreCache()
+
+	if !c.matches(filepath.Join(root, "mod.pyc"), false) {
+		t.Error("mod.pyc should be ignored by the root .gitignore")
+	}
+	if !c.matches(filepath.Join(root, "build"), true) {
+		t.Error("build/ should be ignored by the root .gitignore")
+	}
+	if c.matches(filepath.Join(root, "pkg", "important.pyc"), false) {
+		t.Error("pkg/.gitignore's negation should un-ignore pkg/important.pyc despite the root pattern")
+	}
+	if !c.matches(filepath.Join(root, "pkg", "other.pyc"), false) {
+		t.Error("pkg/other.pyc should still be ignored by the inherited root pattern")
+	}
+}
+
+func TestGitignoreCacheReusesParentPatterns(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, ".gitignore"), "*.pyc\n")
+	sub := filepath.Join(root, "a", "b", "c")
+	if err := os.MkdirAll(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newGitignoreCache()
+	if !c.matches(filepath.Join(sub, "mod.pyc"), false) {
+		t.Error("a deeply nested file should still inherit the root .gitignore pattern")
+	}
+	if _, ok := c.byDir[root]; !ok {
+		t.Error("patternsForLocked should have memoized the root directory's patterns")
+	}
+}
@@ -3,15 +3,19 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/karrick/godirwalk"
@@ -19,18 +23,48 @@ import (
 )
 
 const (
-	portHelp  = "TCP port blackd listens on."
+	portHelp  = "TCP port blackd listens on. Required unless --clear-cache is given."
 	diffHelp  = "Don't write the files back, just output a diff for each file on stdout."
 	checkHelp = "Don't write the files back, just return the status. " +
 		"Return code 0 means nothing would change. Return code 1 means some files would be reformatted. " +
 		"Return code 123 means there was an internal error."
+	lineLengthHelp              = "Line length to target. Overridden by a pyproject.toml found above the file, if any."
+	targetVersionHelp           = "Python version(s) the formatted code should be compatible with, e.g. py36. May be repeated."
+	skipStringNormalizationHelp = "Don't normalize string quotes or prefixes."
+	skipMagicTrailingCommaHelp  = "Don't use trailing commas as a reason to split lines."
+	previewHelp                 = "Enable potentially disruptive style changes that may be added in black's next major release."
+	fastHelp                    = "Skip temporary sanity checks. Default is the safer, slower mode."
+	maxRetriesHelp              = "How many times to retry a blackd request that fails with a connection error, a 5xx, or a timeout."
+	retryTimeoutHelp            = "Per-attempt timeout for a blackd request, within the HTTP client's fixed 5s limit. 0 leaves only that limit."
+	stdinFilenameHelp           = "Read source from stdin and write the result to stdout, as if this were its filename. " +
+		"Only takes effect when no files are given and stdin is not a terminal."
+	includeHelp = "Regex matched against discovered file paths; only matches are formatted."
+	excludeHelp = "Regex matched against discovered paths (directories get a trailing slash); matches are pruned from the walk. " +
+		"Doesn't apply to files passed explicitly as arguments."
+	forceExcludeHelp = "Like --exclude, but also applies to files passed explicitly as arguments."
+	noCacheHelp      = "Don't read or write the on-disk cache of files already known to be Black-clean."
+	clearCacheHelp   = "Remove the on-disk cache of files already known to be Black-clean, then exit without formatting anything."
 )
 
 var (
-	ports = kingpin.Flag("port", portHelp).Required().Uint16List()
-	diff  = kingpin.Flag("diff", diffHelp).Bool()
-	check = kingpin.Flag("check", checkHelp).Bool()
-	files = kingpin.Arg("files", "Files to format").Strings()
+	ports                   = kingpin.Flag("port", portHelp).Uint16List()
+	diff                    = kingpin.Flag("diff", diffHelp).Bool()
+	check                   = kingpin.Flag("check", checkHelp).Bool()
+	lineLength              = kingpin.Flag("line-length", lineLengthHelp).Default("88").Uint()
+	targetVersions          = kingpin.Flag("target-version", targetVersionHelp).Strings()
+	skipStringNormalization = kingpin.Flag("skip-string-normalization", skipStringNormalizationHelp).Bool()
+	skipMagicTrailingComma  = kingpin.Flag("skip-magic-trailing-comma", skipMagicTrailingCommaHelp).Bool()
+	preview                 = kingpin.Flag("preview", previewHelp).Bool()
+	fast                    = kingpin.Flag("fast", fastHelp).Bool()
+	maxRetries              = kingpin.Flag("max-retries", maxRetriesHelp).Default("3").Uint()
+	retryTimeout            = kingpin.Flag("retry-timeout", retryTimeoutHelp).Default("5s").Duration()
+	stdinFilename           = kingpin.Flag("stdin-filename", stdinFilenameHelp).String()
+	include                 = kingpin.Flag("include", includeHelp).Default(DefaultIncludePattern).String()
+	exclude                 = kingpin.Flag("exclude", excludeHelp).Default(DefaultExcludePattern).String()
+	forceExclude            = kingpin.Flag("force-exclude", forceExcludeHelp).String()
+	noCache                 = kingpin.Flag("no-cache", noCacheHelp).Bool()
+	clearCache              = kingpin.Flag("clear-cache", clearCacheHelp).Bool()
+	files                   = kingpin.Arg("files", "Files to format").Strings()
 )
 
 type Action int
@@ -40,6 +74,7 @@ const (
 	Reformatted
 	WouldBeReformatted
 	Error
+	Cancelled
 )
 
 func infof(format string, v ...interface{}) {
@@ -50,20 +85,91 @@ func main() {
 	log.SetFlags(0)
 	kingpin.Parse()
 
-	pathQueue := make(chan string, len(*ports))
+	if *clearCache {
+		path := defaultCachePath()
+		if path == "" {
+			log.Fatal("cannot determine cache location")
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Fatalf("cannot clear cache: %v", err)
+		}
+		return
+	}
+	if len(*ports) == 0 {
+		log.Fatal("required flag --port not provided")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		infof("\ninterrupted, finishing in-flight work and shutting down...\n")
+		cancel()
+	}()
+
+	baseConf := BlackConfig{
+		Check:                   *check,
+		Diff:                    *diff,
+		LineLength:              *lineLength,
+		TargetVersions:          *targetVersions,
+		SkipStringNormalization: *skipStringNormalization,
+		SkipMagicTrailingComma:  *skipMagicTrailingComma,
+		Preview:                 *preview,
+		Fast:                    *fast,
+		MaxRetries:              *maxRetries,
+		RetryTimeout:            *retryTimeout,
+	}
+
+	if len(*files) == 0 && *stdinFilename != "" && stdinIsPiped() {
+		conf := newPyprojectCache().configForPath(baseConf, *stdinFilename)
+		conf.Url = fmt.Sprintf("http://127.0.0.1:%d", (*ports)[0])
+		exitCode := runStdin(ctx, conf, *stdinFilename)
+		signal.Stop(sig)
+		cancel()
+		os.Exit(exitCode)
+	}
+
+	if !*noCache {
+		baseConf.BlackdVersion = probeBlackdVersion(fmt.Sprintf("http://127.0.0.1:%d", (*ports)[0]))
+		fileCache = openBlackCache(defaultCachePath())
+	}
+
+	filter, err := newPathFilter(*include, *exclude, *forceExclude)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	pathQueue := make(chan workItem, len(*ports))
 	actQueue := make(chan Action, 99)
 
 	wg := sync.WaitGroup{}
 	for _, port := range *ports {
 		wg.Add(1)
 		go func(port string) {
-			conf := BlackConfig{
-				Url:   fmt.Sprintf("http://127.0.0.1:%s", port),
-				Check: *check,
-				Diff:  *diff,
-			}
-			for path := range pathQueue {
-				actQueue <- processPath(conf, path)
+			url := fmt.Sprintf("http://127.0.0.1:%s", port)
+			breaker := &circuitBreaker{}
+			for item := range pathQueue {
+				if ctx.Err() != nil {
+					actQueue <- Cancelled
+					continue
+				}
+				if cooldown := breaker.cooldown(); cooldown > 0 {
+					infof("blackd on %s looks unhealthy, pausing that worker for %s\n", url, cooldown.Round(time.Second))
+					select {
+					case <-time.After(cooldown):
+					case <-ctx.Done():
+						actQueue <- Cancelled
+						continue
+					}
+				}
+				conf := item.conf
+				conf.Url = url
+				act, err, attempted := processPath(ctx, conf, item.path)
+				if attempted {
+					breaker.recordResult(err)
+				}
+				actQueue <- act
 			}
 			wg.Done()
 		}(strconv.FormatUint(uint64(port), 10))
@@ -74,40 +180,86 @@ func main() {
 		close(actQueue)
 	}()
 
-	go walkDirectories(*files, pathQueue)
+	go walkDirectories(ctx, *files, baseConf, filter, pathQueue)
+
+	exitCode := report(*check, actQueue)
+	if fileCache != nil {
+		if err := fileCache.persist(); err != nil {
+			infof("warning: %v\n", err)
+		}
+	}
+	signal.Stop(sig)
+	cancel()
+	os.Exit(exitCode)
+}
 
-	os.Exit(report(*check, actQueue))
+// workItem pairs a path discovered by walkDirectories with the BlackConfig
+// resolved for it (CLI flags overridden by any pyproject.toml found above
+// it). The URL is filled in by whichever worker picks the item up.
+type workItem struct {
+	path string
+	conf BlackConfig
 }
 
-func walkDirectories(paths []string, pathQueue chan<- string) {
-	for _, path := range paths {
-		err := godirwalk.Walk(path, &godirwalk.Options{
+var errWalkCancelled = fmt.Errorf("walk cancelled")
+
+func walkDirectories(ctx context.Context, paths []string, baseConf BlackConfig, filter *pathFilter, pathQueue chan<- workItem) {
+	pyCache := newPyprojectCache()
+	for _, root := range paths {
+		if ctx.Err() != nil {
+			break
+		}
+
+		// A file named explicitly on the command line bypasses
+		// --include/--exclude and any .gitignore, same as Black itself,
+		// but --force-exclude still applies.
+		if de, statErr := os.Stat(root); statErr == nil && !de.IsDir() {
+			if !filter.forceExcluded(root) {
+				pathQueue <- workItem{path: root, conf: pyCache.configForPath(baseConf, root)}
+			}
+			continue
+		}
+
+		err := godirwalk.Walk(root, &godirwalk.Options{
 			FollowSymbolicLinks: true,
 			Unsorted:            true,
 			AllowNonDirectory:   true,
 			Callback: func(path string, de *godirwalk.Dirent) error {
-				if de.IsRegular() && strings.HasSuffix(path, ".py") {
-					pathQueue <- path
+				if ctx.Err() != nil {
+					return errWalkCancelled
+				}
+				if de.IsDir() {
+					if path != root && filter.skipDir(path) {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if de.IsRegular() && !filter.skipFile(path) {
+					pathQueue <- workItem{path: path, conf: pyCache.configForPath(baseConf, path)}
 				}
 				return nil
 			},
 			ErrorCallback: func(path string, err error) godirwalk.ErrorAction {
+				if filter.skipDir(path) {
+					return godirwalk.SkipNode
+				}
 				infof("cannot format %s: %v\n", path, err)
 				return godirwalk.SkipNode
 			},
 		})
-		if err != nil {
-			log.Fatalf("error traversing %s: %v", path, err)
+		if err != nil && err != errWalkCancelled {
+			log.Fatalf("error traversing %s: %v", root, err)
 		}
 	}
 	close(pathQueue)
 }
 
 func report(check bool, actQueue <-chan Action) int {
-	exitCode := 0
 	unchangedCount := 0
 	reformattedCount := 0
+	wouldBeReformattedCount := 0
 	errorCount := 0
+	cancelledCount := 0
 	for act := range actQueue {
 		switch act {
 		case Unchanged:
@@ -116,16 +268,28 @@ func report(check bool, actQueue <-chan Action) int {
 			reformattedCount += 1
 		case WouldBeReformatted:
 			reformattedCount += 1
-			if exitCode < 1 {
-				exitCode = 1
-			}
+			wouldBeReformattedCount += 1
 		case Error:
 			errorCount += 1
-			exitCode = 123
+		case Cancelled:
+			cancelledCount += 1
 		}
 	}
 
-	if unchangedCount == 0 && reformattedCount == 0 && errorCount == 0 {
+	// Priority is fixed (Error > Cancelled > WouldBeReformatted), not
+	// dependent on the order actions arrived on actQueue, since multiple
+	// worker goroutines feed it concurrently.
+	exitCode := 0
+	switch {
+	case errorCount > 0:
+		exitCode = 123
+	case cancelledCount > 0:
+		exitCode = 130
+	case wouldBeReformattedCount > 0:
+		exitCode = 1
+	}
+
+	if unchangedCount == 0 && reformattedCount == 0 && errorCount == 0 && cancelledCount == 0 {
 		fmt.Println("No Python files are present to be formatted. Nothing to do 😴")
 		return exitCode
 	}
@@ -140,6 +304,9 @@ func report(check bool, actQueue <-chan Action) int {
 	if errorCount > 0 {
 		reportCount(&b, check, errorCount, "would fail to reformat", "failed to reformat")
 	}
+	if cancelledCount > 0 {
+		reportCount(&b, check, cancelledCount, "would be cancelled", "cancelled")
+	}
 	b.WriteRune('.')
 	log.Println(b.String())
 	return exitCode
@@ -164,11 +331,35 @@ func reportCount(buf *strings.Builder, check bool, count int, statusWithCheck, s
 	}
 }
 
-func processPath(conf BlackConfig, path string) Action {
-	resp, err := queryBlackd(conf, path)
+// processPath formats a single file via blackd and returns the resulting
+// Action, the error (if any) that the calling worker's circuit breaker
+// should track, and whether a blackd request was attempted. That error is
+// whatever the request still failed with after its retries: a connection
+// error, a timeout, a 5xx response, or a failure to open path.
+// A nil error means blackd itself was reachable and healthy, even if the
+// Action is Error for other reasons (bad syntax, a write failure, ...). A
+// false attempted means a cache hit resolved this path without ever
+// touching the network, so the caller must not feed the result into its
+// circuit breaker -- doing so would reset consecutiveFailures on a result
+// that says nothing about blackd's health.
+func processPath(ctx context.Context, conf BlackConfig, path string) (Action, error, bool) {
+	var key string
+	if fileCache != nil {
+		if hash, err := hashFile(path); err == nil {
+			key = cacheKey(conf, path, hash)
+			if fileCache.has(key) {
+				return Unchanged, nil, false
+			}
+		}
+	}
+
+	resp, err := queryBlackdWithRetry(ctx, conf, path, openFile(path), conf.MaxRetries, conf.RetryTimeout)
 	if err != nil {
+		if ctx.Err() != nil {
+			return Cancelled, nil, true
+		}
 		infof("error: cannot format %s: %v\n", path, err)
-		return Error
+		return Error, err, true
 	}
 	defer resp.Body.Close()
 	defer io.Copy(ioutil.Discard, resp.Body)
@@ -180,24 +371,27 @@ func processPath(conf BlackConfig, path string) Action {
 		} else {
 			infof("cannot format %s: %s\n", path, blackErr.Msg)
 		}
-		return Error
+		return Error, nil, true
 	}
 	if !res.Changed {
-		return Unchanged
+		if key != "" {
+			fileCache.add(key)
+		}
+		return Unchanged, nil, true
 	}
 	if conf.Diff && !printDiff(path, res.Text) {
-		return Error
+		return Error, nil, true
 	}
 	if conf.Check {
 		infof("would reformat %s\n", path)
-		return WouldBeReformatted
+		return WouldBeReformatted, nil, true
 	}
 	if err = overwritePath(path, res.Text); err != nil {
 		log.Print(err)
-		return Error
+		return Error, nil, true
 	}
 	infof("reformatted %s\n", path)
-	return Reformatted
+	return Reformatted, nil, true
 }
 
 func printDiff(path string, diff io.Reader) bool {
@@ -247,24 +441,35 @@ func newHttpClient() *http.Client {
 
 var (
 	client = newHttpClient()
+	// fileCache is nil when --no-cache was given, or for the duration of
+	// --stdin-filename runs, which don't use it.
+	fileCache *blackCache
 )
 
-func queryBlackd(conf BlackConfig, path string) (*http.Response, error) {
-	file, err := os.Open(path)
+// bodyOpener produces a fresh, unread request body. queryBlackd calls it
+// once per attempt so that retries never reuse an exhausted reader.
+type bodyOpener func() (io.ReadCloser, error)
+
+func openFile(path string) bodyOpener {
+	return func() (io.ReadCloser, error) {
+		return os.Open(path)
+	}
+}
+
+func queryBlackd(ctx context.Context, conf BlackConfig, path string, open bodyOpener) (*http.Response, error) {
+	file, err := open()
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
 	r := bufio.NewReader(file)
-	req, err := http.NewRequest("POST", conf.Url, r)
+	req, err := http.NewRequestWithContext(ctx, "POST", conf.Url, r)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %v", path, err)
 	}
 
-	if conf.Diff {
-		req.Header.Set("X-Diff", "1")
-	}
+	setBlackdHeaders(req, conf, path)
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("%s: couldn't reach blackd: %v", path, err)
@@ -272,6 +477,30 @@ func queryBlackd(conf BlackConfig, path string) (*http.Response, error) {
 	return resp, nil
 }
 
+func setBlackdHeaders(req *http.Request, conf BlackConfig, path string) {
+	if conf.Diff {
+		req.Header.Set("X-Diff", "1")
+	}
+	if conf.LineLength > 0 {
+		req.Header.Set("X-Line-Length", strconv.FormatUint(uint64(conf.LineLength), 10))
+	}
+	if variant := conf.pythonVariant(path); variant != "" {
+		req.Header.Set("X-Python-Variant", variant)
+	}
+	if conf.SkipStringNormalization {
+		req.Header.Set("X-Skip-String-Normalization", "1")
+	}
+	if conf.SkipMagicTrailingComma {
+		req.Header.Set("X-Skip-Magic-Trailing-Comma", "1")
+	}
+	if conf.Preview {
+		req.Header.Set("X-Preview", "1")
+	}
+	if conf.Fast {
+		req.Header.Set("X-Fast-Or-Safe", "fast")
+	}
+}
+
 func newBlackResult(resp *http.Response) (*BlackResult, *BlackError) {
 	switch resp.StatusCode {
 	case 204:
@@ -287,27 +516,45 @@ func newBlackResult(resp *http.Response) (*BlackResult, *BlackError) {
 	return nil, nil // never reached
 }
 
+// overwritePath replaces path's contents with newContents by writing to a
+// temporary file in the same directory and renaming it into place, so that
+// a process interrupted mid-write (e.g. by SIGINT) never leaves a truncated
+// .py file on disk.
 func overwritePath(path string, newContents io.Reader) error {
-	file, err := os.Create(path)
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".*.tmp")
 	if err != nil {
 		return fmt.Errorf("%s: cannot format: %v", path, err)
 	}
-	defer file.Close()
-	w := bufio.NewWriter(file)
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // no-op once the rename below succeeds
+	if info, statErr := os.Stat(path); statErr == nil {
+		if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+			tmp.Close()
+			return fmt.Errorf("%s: formatting failed: %v", path, err)
+		}
+	}
+
+	w := bufio.NewWriter(tmp)
 	_, err = io.Copy(w, newContents)
 	if err == nil {
-		err = file.Sync()
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
 	}
 	if err != nil {
 		return fmt.Errorf("%s: formatting failed: %v", path, err)
 	}
-	return nil
-}
 
-type BlackConfig struct {
-	Url   string
-	Diff  bool
-	Check bool
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("%s: formatting failed: %v", path, err)
+	}
+	return nil
 }
 
 type BlackResult struct {
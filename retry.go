@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxErrorBodyBytes bounds how much of a non-2xx blackd response body we
+// keep for diagnostics, so a misbehaving daemon can't make a single retry
+// attempt buffer an unbounded amount of memory.
+const maxErrorBodyBytes = 4096
+
+const (
+	retryInitialBackoff = 200 * time.Millisecond
+	retryMaxBackoff     = 10 * time.Second
+)
+
+// queryBlackdWithRetry wraps queryBlackd with bounded exponential backoff
+// and full jitter, retrying on connection errors, context-deadline
+// timeouts, and 5xx responses from blackd. Each attempt reopens the source
+// file from scratch, since queryBlackd's bufio.Reader is exhausted after a
+// failed attempt.
+func queryBlackdWithRetry(ctx context.Context, conf BlackConfig, path string, open bodyOpener, maxRetries uint, retryTimeout time.Duration) (*http.Response, error) {
+	var lastErr error
+	for attempt := uint(0); attempt <= maxRetries; attempt++ {
+		if attempt > 0 {
+			if err := sleepBackoff(ctx, attempt); err != nil {
+				return nil, lastErr
+			}
+		}
+
+		resp, err := attemptQuery(ctx, conf, path, open, retryTimeout)
+		if err == nil && resp.StatusCode < 500 {
+			return resp, nil
+		}
+		if err == nil {
+			body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes))
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			if msg := strings.TrimSpace(string(body)); msg != "" {
+				lastErr = fmt.Errorf("%s: blackd returned %s: %s", path, resp.Status, msg)
+			} else {
+				lastErr = fmt.Errorf("%s: blackd returned %s", path, resp.Status)
+			}
+		} else {
+			lastErr = err
+		}
+		if ctx.Err() != nil {
+			return nil, lastErr
+		}
+	}
+	return nil, lastErr
+}
+
+func attemptQuery(ctx context.Context, conf BlackConfig, path string, open bodyOpener, retryTimeout time.Duration) (*http.Response, error) {
+	if retryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, retryTimeout)
+		defer cancel()
+	}
+	return queryBlackd(ctx, conf, path, open)
+}
+
+func sleepBackoff(ctx context.Context, attempt uint) error {
+	select {
+	case <-time.After(backoffDuration(attempt)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// backoffDuration computes an exponential backoff for the given 1-based
+// attempt number, with full jitter so that many workers retrying at once
+// don't all hammer blackd in lockstep.
+func backoffDuration(attempt uint) time.Duration {
+	d := retryInitialBackoff << attempt
+	if d <= 0 || d > retryMaxBackoff {
+		d = retryMaxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+const (
+	circuitBreakerThreshold = 3
+	circuitBreakerCooldown  = 30 * time.Second
+)
+
+// circuitBreaker tracks consecutive failures for one blackd instance. Once
+// it trips, its worker pauses for a cooldown period instead of pulling more
+// work from the shared path queue, which naturally rebalances pending
+// paths onto the other, healthy workers.
+type circuitBreaker struct {
+	mu                  sync.Mutex
+	consecutiveFailures uint
+	trippedUntil        time.Time
+}
+
+func (b *circuitBreaker) recordResult(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.consecutiveFailures = 0
+		b.trippedUntil = time.Time{}
+		return
+	}
+	b.consecutiveFailures++
+	if b.consecutiveFailures >= circuitBreakerThreshold {
+		b.trippedUntil = time.Now().Add(circuitBreakerCooldown)
+	}
+}
+
+// cooldown returns how much longer this breaker's worker should pause
+// before trying again, or zero or less if it's healthy.
+func (b *circuitBreaker) cooldown() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Until(b.trippedUntil)
+}
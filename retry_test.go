@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffDurationBounds(t *testing.T) {
+	for attempt := uint(0); attempt < 10; attempt++ {
+		d := backoffDuration(attempt)
+		if d < 0 {
+			t.Fatalf("backoffDuration(%d) = %s, want non-negative", attempt, d)
+		}
+		if d > retryMaxBackoff {
+			t.Fatalf("backoffDuration(%d) = %s, want at most %s", attempt, d, retryMaxBackoff)
+		}
+	}
+}
+
+func TestBackoffDurationStartsSmallThenCaps(t *testing.T) {
+	// Attempt 0 must stay within the initial backoff; a large attempt
+	// must saturate at retryMaxBackoff rather than
+	// overflow or go negative (the bit-shift in backoffDuration would
+	// otherwise wrap around for a large enough attempt).
+	small := backoffDuration(0)
+	if small > retryInitialBackoff {
+		t.Errorf("backoffDuration(0) = %s, want at most the initial backoff %s", small, retryInitialBackoff)
+	}
+
+	huge := backoffDuration(63)
+	if huge > retryMaxBackoff {
+		t.Errorf("backoffDuration(63) = %s, want capped at %s", huge, retryMaxBackoff)
+	}
+}
+
+func TestCircuitBreakerTripsAfterThreshold(t *testing.T) {
+	b := &circuitBreaker{}
+	for i := uint(0); i < circuitBreakerThreshold-1; i++ {
+		b.recordResult(errDummy)
+		if b.cooldown() > 0 {
+			t.Fatalf("breaker tripped after %d failures, want it to stay healthy until %d", i+1, circuitBreakerThreshold)
+		}
+	}
+	b.recordResult(errDummy)
+	if b.cooldown() <= 0 {
+		t.Fatalf("breaker did not trip after %d consecutive failures", circuitBreakerThreshold)
+	}
+}
+
+func TestCircuitBreakerResetsOnSuccess(t *testing.T) {
+	b := &circuitBreaker{}
+	for i := uint(0); i < circuitBreakerThreshold; i++ {
+		b.recordResult(errDummy)
+	}
+	if b.cooldown() <= 0 {
+		t.Fatal("breaker should be tripped before the reset under test")
+	}
+	b.recordResult(nil)
+	if b.cooldown() > 0 {
+		t.Fatal("a successful result should immediately clear the breaker's cooldown")
+	}
+}
+
+func TestCircuitBreakerCooldownDecreases(t *testing.T) {
+	b := &circuitBreaker{trippedUntil: time.Now().Add(circuitBreakerCooldown)}
+	first := b.cooldown()
+	time.Sleep(5 * time.Millisecond)
+	second := b.cooldown()
+	if second >= first {
+		t.Errorf("cooldown() = %s then %s, want it to decrease over time", first, second)
+	}
+}
+
+var errDummy = &dummyErr{"connection refused"}
+
+type dummyErr struct{ msg string }
+
+func (e *dummyErr) Error() string { return e.msg }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// stdinIsPiped reports whether os.Stdin is something other than an
+// interactive terminal, i.e. whether there is input worth reading.
+func stdinIsPiped() bool {
+	stat, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	return stat.Mode()&os.ModeCharDevice == 0
+}
+
+// runStdin implements Black's own `black -` / `--stdin-filename` workflow:
+// read Python source from stdin, format it through a single blackd
+// instance, and write the result (or, under --diff, the diff) to stdout.
+// It bypasses walkDirectories, overwritePath and the action-report
+// machinery entirely, since there is exactly one file and nowhere to write
+// it back to but stdout. The --check exit-code semantics are preserved.
+func runStdin(ctx context.Context, conf BlackConfig, stdinFilename string) int {
+	src, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		infof("error: cannot read stdin: %v\n", err)
+		return 123
+	}
+	open := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(src)), nil
+	}
+
+	resp, err := queryBlackdWithRetry(ctx, conf, stdinFilename, open, conf.MaxRetries, conf.RetryTimeout)
+	if err != nil {
+		infof("error: cannot format %s: %v\n", stdinFilename, err)
+		return 123
+	}
+	defer resp.Body.Close()
+	defer io.Copy(ioutil.Discard, resp.Body)
+
+	res, blackErr := newBlackResult(resp)
+	if blackErr != nil {
+		infof("%s: %s\n", stdinFilename, blackErr.Msg)
+		return 123
+	}
+	if !res.Changed {
+		if !conf.Check && !conf.Diff {
+			_, _ = os.Stdout.Write(src)
+		}
+		return 0
+	}
+	if conf.Diff {
+		if !printDiff(stdinFilename, res.Text) {
+			return 123
+		}
+	} else if !conf.Check {
+		if _, err := io.Copy(os.Stdout, res.Text); err != nil {
+			infof("error: cannot write to stdout: %v\n", err)
+			return 123
+		}
+	}
+	if conf.Check {
+		return 1
+	}
+	return 0
+}